@@ -0,0 +1,195 @@
+// Copyright 2018 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/google/syzkaller/pkg/log"
+)
+
+// traceFormat tells expandTraceFile how to interpret a -file/-dir entry.
+type traceFormat int
+
+const (
+	formatAuto traceFormat = iota
+	formatStrace
+	formatTar
+)
+
+func parseFormatFlag(s string) traceFormat {
+	switch s {
+	case "", "auto":
+		return formatAuto
+	case "strace":
+		return formatStrace
+	case "tar":
+		return formatTar
+	default:
+		log.Fatalf("unknown -format %q, want auto/strace/tar", s)
+	}
+	return formatAuto
+}
+
+// detectFormat guesses a format from the file extension, ignoring any
+// trailing compression suffix.
+func detectFormat(path string) traceFormat {
+	base := strings.TrimSuffix(strings.TrimSuffix(path, ".gz"), ".zst")
+	if strings.HasSuffix(base, ".tar") || strings.HasSuffix(path, ".tgz") {
+		return formatTar
+	}
+	return formatStrace
+}
+
+// traceMember is one trace file extracted from a -file/-dir entry: path is
+// what parser.Parse should open, and name is the original entry's basename -
+// not filepath.Base(path), which for a compressed or tar-sourced entry names
+// the FIFO standing in for it, not the trace itself. -seccomp and
+// -deserialize output is named after name, so it matches the source trace
+// regardless of how its bytes got here.
+type traceMember struct {
+	path string
+	name string
+}
+
+// expandTraceFile turns a single input path - a plain strace log, a gzip or
+// zstd compressed log, or a tar/tar.gz bundle of logs - into the trace
+// entries it contains, calling onMember once per entry. Compressed and
+// archived input is streamed through a named pipe rather than spilled to a
+// temp file, so a multi-gigabyte compressed trace never has to be fully
+// decompressed onto disk (or held in memory) before parser.Parse reads it.
+func expandTraceFile(path string, format traceFormat, tmpDir string, onMember func(traceMember) error) error {
+	if format == formatAuto {
+		format = detectFormat(path)
+	}
+	compressed := strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".zst") || strings.HasSuffix(path, ".tgz")
+	if format == formatStrace && !compressed {
+		return onMember(traceMember{path: path, name: filepath.Base(path)})
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, closeR, err := decompressReader(path, f)
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s: %v", path, err)
+	}
+	defer closeR()
+
+	if format == formatTar {
+		return streamTarMembers(tmpDir, r, onMember)
+	}
+	name := filepath.Base(strings.TrimSuffix(strings.TrimSuffix(path, ".gz"), ".zst"))
+	return streamToFIFO(tmpDir, name, r, onMember)
+}
+
+// decompressReader wraps r in a gzip or zstd reader if path's extension calls
+// for it, otherwise it returns r unchanged. The returned func must be called
+// once the caller is done reading.
+func decompressReader(path string, r io.Reader) (io.Reader, func(), error) {
+	switch {
+	case strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, func() { gz.Close() }, nil
+	case strings.HasSuffix(path, ".zst"):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	default:
+		return r, func() {}, nil
+	}
+}
+
+// streamTarMembers walks every regular file in the tar stream r and hands
+// each one to onMember in turn, one at a time, since a tar.Reader can only
+// read its current entry before advancing to the next.
+func streamTarMembers(tmpDir string, r io.Reader, onMember func(traceMember) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar entry: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := streamToFIFO(tmpDir, filepath.Base(hdr.Name), tr, onMember); err != nil {
+			return err
+		}
+	}
+}
+
+// streamToFIFO bridges r to onMember through a named pipe instead of a plain
+// temp file: a FIFO has no backing store, just the kernel's pipe buffer, so
+// the writer goroutine below blocks on io.Copy until onMember's consumer
+// reads the bytes, and nothing r produces is ever buffered in full.
+func streamToFIFO(tmpDir, name string, r io.Reader, onMember func(traceMember) error) error {
+	fifoPath, err := reserveFIFOPath(tmpDir, name)
+	if err != nil {
+		return fmt.Errorf("failed to reserve fifo path for %s: %v", name, err)
+	}
+	if err := syscall.Mkfifo(fifoPath, 0600); err != nil {
+		return fmt.Errorf("failed to create fifo for %s: %v", name, err)
+	}
+	defer os.Remove(fifoPath)
+
+	copyErr := make(chan error, 1)
+	go func() {
+		w, err := os.OpenFile(fifoPath, os.O_WRONLY, 0)
+		if err != nil {
+			copyErr <- err
+			return
+		}
+		_, err = io.Copy(w, r)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		copyErr <- err
+	}()
+
+	if err := onMember(traceMember{path: fifoPath, name: name}); err != nil {
+		<-copyErr // drain so the writer goroutine above doesn't leak
+		return err
+	}
+	if err := <-copyErr; err != nil {
+		return fmt.Errorf("failed to stream %s: %v", name, err)
+	}
+	return nil
+}
+
+// reserveFIFOPath returns a path under tmpDir that doesn't currently exist,
+// reusing ioutil.TempFile's collision-free naming rather than inventing our
+// own; the file it creates is immediately removed since the caller wants the
+// name for a FIFO, not a regular file.
+func reserveFIFOPath(tmpDir, base string) (string, error) {
+	f, err := ioutil.TempFile(tmpDir, base+"-*.fifo")
+	if err != nil {
+		return "", err
+	}
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+	return path, nil
+}
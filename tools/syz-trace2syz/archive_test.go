@@ -0,0 +1,209 @@
+// Copyright 2018 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		path string
+		want traceFormat
+	}{
+		{"trace.log", formatStrace},
+		{"trace.log.gz", formatStrace},
+		{"trace.log.zst", formatStrace},
+		{"traces.tar", formatTar},
+		{"traces.tar.gz", formatTar},
+		{"traces.tgz", formatTar},
+	}
+	for _, test := range tests {
+		if got := detectFormat(test.path); got != test.want {
+			t.Errorf("detectFormat(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+// collectMembers runs expandTraceFile and returns each member's name paired
+// with the full content read from its path, in the order onMember saw them.
+func collectMembers(t *testing.T, path string, format traceFormat, tmpDir string) []traceMember {
+	t.Helper()
+	var members []traceMember
+	var contents []string
+	err := expandTraceFile(path, format, tmpDir, func(m traceMember) error {
+		data, err := ioutil.ReadFile(m.path)
+		if err != nil {
+			return err
+		}
+		members = append(members, m)
+		contents = append(contents, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expandTraceFile failed: %v", err)
+	}
+	for i := range members {
+		members[i].path = contents[i] // repurpose path to carry the content read, for assertions below
+	}
+	return members
+}
+
+func TestExpandTraceFilePlain(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "trace.log")
+	if err := ioutil.WriteFile(path, []byte("plain trace"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	members := collectMembers(t, path, formatAuto, tmpDir)
+	if len(members) != 1 || members[0].name != "trace.log" || members[0].path != "plain trace" {
+		t.Fatalf("expandTraceFile returned %+v", members)
+	}
+}
+
+func TestExpandTraceFileGzip(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "trace.log.gz")
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte("compressed trace")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	members := collectMembers(t, path, formatAuto, tmpDir)
+	if len(members) != 1 {
+		t.Fatalf("expandTraceFile returned %d members, want 1", len(members))
+	}
+	if members[0].name != "trace.log" {
+		t.Errorf("member name = %q, want %q", members[0].name, "trace.log")
+	}
+	if members[0].path != "compressed trace" {
+		t.Errorf("decompressed content = %q, want %q", members[0].path, "compressed trace")
+	}
+}
+
+func TestExpandTraceFileTar(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "traces.tar")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := map[string]string{
+		"a.log": "trace a",
+		"b.log": "trace b",
+	}
+	for name, content := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(content)), Mode: 0640}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	members := collectMembers(t, path, formatAuto, tmpDir)
+	if len(members) != len(entries) {
+		t.Fatalf("expandTraceFile returned %d members, want %d", len(members), len(entries))
+	}
+	got := make(map[string]string)
+	for _, m := range members {
+		got[m.name] = m.path
+	}
+	var gotNames, wantNames []string
+	for name := range got {
+		gotNames = append(gotNames, name)
+	}
+	for name := range entries {
+		wantNames = append(wantNames, name)
+	}
+	sort.Strings(gotNames)
+	sort.Strings(wantNames)
+	if len(gotNames) != len(wantNames) {
+		t.Fatalf("tar member names = %v, want %v", gotNames, wantNames)
+	}
+	for i := range wantNames {
+		if gotNames[i] != wantNames[i] {
+			t.Fatalf("tar member names = %v, want %v", gotNames, wantNames)
+		}
+	}
+	for name, content := range entries {
+		if got[name] != content {
+			t.Errorf("tar member %q content = %q, want %q", name, got[name], content)
+		}
+	}
+}
+
+func TestExpandTraceFileForcedFormat(t *testing.T) {
+	tmpDir := t.TempDir()
+	// No extension at all, so auto-detection would guess strace; -format tar
+	// must override that.
+	path := filepath.Join(tmpDir, "bundle")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "only.log", Size: 5, Mode: 0640}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("trace")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	members := collectMembers(t, path, formatTar, tmpDir)
+	if len(members) != 1 || members[0].name != "only.log" {
+		t.Fatalf("expandTraceFile returned %+v", members)
+	}
+}
+
+// TestExpandTraceFileDoesNotLeakFIFOs checks that streamToFIFO cleans up the
+// named pipe it creates once onMember is done with it, so a long -dir run
+// doesn't accumulate stale fifo nodes under tmpDir.
+func TestExpandTraceFileDoesNotLeakFIFOs(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "trace.log.gz")
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	collectMembers(t, path, formatAuto, tmpDir)
+
+	infos, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if info.Name() != filepath.Base(path) {
+			t.Errorf("tmpDir still contains %s after expandTraceFile returned", info.Name())
+		}
+	}
+}
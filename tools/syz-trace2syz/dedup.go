@@ -0,0 +1,123 @@
+// Copyright 2018 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	iradix "github.com/hashicorp/go-immutable-radix"
+
+	"github.com/google/syzkaller/pkg/db"
+	"github.com/google/syzkaller/pkg/log"
+	"github.com/google/syzkaller/prog"
+	"github.com/google/syzkaller/tools/syz-trace2syz/proggen"
+)
+
+// dedupIndex content-addresses every program written to corpus.db so that
+// traces which differ only in resource IDs or don't-care flag bits collapse
+// into a single entry instead of bloating the corpus. Pointer addresses are
+// part of the canonical form, so programs that differ in them stay separate. It's the single writer's dedup step,
+// so all methods assume they're called from one goroutine at a time.
+type dedupIndex struct {
+	canon *proggen.Canonicalizer
+	db    *db.DB
+	tree  *iradix.Tree
+
+	seeded, total, unique uint64
+	largestDup            int
+}
+
+type dedupEntry struct {
+	key  string
+	size int
+	dup  int
+}
+
+// newDedupIndex builds a dedup index for syzDb, seeded from whatever it
+// already contains (e.g. from an earlier -dir invocation that the -jobs
+// checkpoint let us resume), so a trace that duplicates a program written by
+// a previous run is still caught instead of only deduping within this run's
+// batch. Each record is deserialized under whichever of targets actually
+// accepts it, since a -targets run's corpus.db can hold records from more
+// than one target; a record none of them accept is skipped rather than seeded.
+func newDedupIndex(syzDb *db.DB, targets []*prog.Target) *dedupIndex {
+	d := &dedupIndex{canon: proggen.NewCanonicalizer(), db: syzDb, tree: iradix.New()}
+	for key, rec := range syzDb.Records {
+		p, err := deserializeUnderAny(targets, rec.Val)
+		if err != nil {
+			log.Logf(1, "dedup: failed to deserialize existing record %s: %v", key, err)
+			continue
+		}
+		contentID := sha256.Sum256(d.canon.Canonicalize(p))
+		tree, _, _ := d.tree.Insert(contentID[:], &dedupEntry{key: key, size: len(rec.Val), dup: 1})
+		d.tree = tree
+		d.seeded++
+	}
+	return d
+}
+
+// deserializeUnderAny tries every target in turn, returning the first one
+// that accepts data. Trying all of them (rather than just the first target)
+// is what lets seeding work for a multi-target corpus.db.
+func deserializeUnderAny(targets []*prog.Target, data []byte) (*prog.Prog, error) {
+	var lastErr error
+	for _, target := range targets {
+		p, err := target.Deserialize(data, prog.NonStrict)
+		if err == nil {
+			return p, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// save writes p under key, unless the radix tree already holds a program with
+// the same canonical form, in which case the two are merged by keeping
+// whichever serializes to fewer bytes.
+func (d *dedupIndex) save(key string, p *prog.Prog) {
+	d.total++
+	contentID := sha256.Sum256(d.canon.Canonicalize(p))
+	data := p.Serialize()
+
+	if v, ok := d.tree.Get(contentID[:]); ok {
+		entry := v.(*dedupEntry)
+		entry.dup++
+		if entry.dup > d.largestDup {
+			d.largestDup = entry.dup
+		}
+		if len(data) < entry.size {
+			d.db.Delete(entry.key)
+			savedKey := d.uniqueKey(key)
+			d.db.Save(savedKey, data, 0)
+			entry.key, entry.size = savedKey, len(data)
+		}
+		return
+	}
+
+	d.unique++
+	savedKey := d.uniqueKey(key)
+	d.db.Save(savedKey, data, 0)
+	tree, _, _ := d.tree.Insert(contentID[:], &dedupEntry{key: savedKey, size: len(data), dup: 1})
+	d.tree = tree
+}
+
+// uniqueKey guards against the (extremely unlikely) case where the raw
+// serialize-hash key collides with an unrelated, non-duplicate program.
+func (d *dedupIndex) uniqueKey(key string) string {
+	if _, ok := d.db.Records[key]; !ok {
+		return key
+	}
+	for i := 0; ; i++ {
+		k := key + fmt.Sprint(i)
+		if _, ok := d.db.Records[k]; !ok {
+			return k
+		}
+	}
+}
+
+func (d *dedupIndex) logStats() {
+	log.Logf(0, "dedup: %d seeded from existing corpus.db, %d/%d programs unique this run, largest duplicate cluster: %d",
+		d.seeded, d.unique, d.total, d.largestDup)
+}
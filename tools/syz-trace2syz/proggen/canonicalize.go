@@ -0,0 +1,113 @@
+// Copyright 2018 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package proggen
+
+import (
+	"encoding/binary"
+
+	"github.com/google/syzkaller/prog"
+)
+
+// Canonicalizer produces a stable byte encoding of a *prog.Prog that is
+// insensitive to noise introduced by tracing the same workload twice: the
+// concrete resource IDs a trace happened to observe and don't-care bits in
+// flag arguments. Argument groups (arrays, structs) are encoded positionally
+// - syzkaller doesn't expose which group types are actually order-independent,
+// and guessing wrong collapses genuinely distinct positional arrays (e.g.
+// iovec[] for writev/readv) into false duplicates, which is worse than not
+// deduplicating them at all. Two programs with the same canonical form
+// describe the same syscall sequence and are treated as duplicates by the
+// corpus deduplicator.
+//
+// A Canonicalizer holds no state of its own and is safe for concurrent use.
+type Canonicalizer struct{}
+
+// NewCanonicalizer returns a ready-to-use Canonicalizer.
+func NewCanonicalizer() *Canonicalizer {
+	return &Canonicalizer{}
+}
+
+// Canonicalize returns p's canonical byte form. It does not mutate p.
+func (c *Canonicalizer) Canonicalize(p *prog.Prog) []byte {
+	ids := make(map[*prog.ResultArg]uint32)
+	var buf []byte
+	for _, call := range p.Calls {
+		buf = append(buf, call.Meta.Name...)
+		buf = append(buf, 0)
+		for _, arg := range call.Args {
+			buf = c.canonicalizeArg(buf, arg, ids)
+		}
+		if call.Ret != nil {
+			buf = c.canonicalizeArg(buf, call.Ret, ids)
+		}
+		buf = append(buf, '\n')
+	}
+	return buf
+}
+
+func (c *Canonicalizer) canonicalizeArg(buf []byte, arg prog.Arg, ids map[*prog.ResultArg]uint32) []byte {
+	switch a := arg.(type) {
+	case *prog.ResultArg:
+		// Resources are identified by which definition they point back to,
+		// not by the arbitrary ID the trace assigned them, so renumber them
+		// in the order they're first seen.
+		target := a
+		if a.Res != nil {
+			target = a.Res
+		}
+		id, ok := ids[target]
+		if !ok {
+			id = uint32(len(ids))
+			ids[target] = id
+		}
+		return appendUint32(buf, id)
+	case *prog.ConstArg:
+		return appendUint64(buf, a.Val&careMask(a))
+	case *prog.DataArg:
+		return append(buf, a.Data()...)
+	case *prog.PointerArg:
+		buf = appendUint64(buf, a.VmAddr)
+		if a.Res != nil {
+			buf = c.canonicalizeArg(buf, a.Res, ids)
+		}
+		return buf
+	case *prog.UnionArg:
+		buf = appendUint32(buf, uint32(a.Index))
+		return c.canonicalizeArg(buf, a.Option, ids)
+	case *prog.GroupArg:
+		for _, inner := range a.Inner {
+			buf = c.canonicalizeArg(buf, inner, ids)
+		}
+		return buf
+	default:
+		return buf
+	}
+}
+
+// careMask masks out the bits of a flags argument that the type generator
+// leaves as don't-care noise, so two traces that happened to observe
+// different garbage in those bits still canonicalize identically.
+func careMask(a *prog.ConstArg) uint64 {
+	flags, ok := a.Type().(*prog.FlagsType)
+	if !ok {
+		return ^uint64(0)
+	}
+	var mask uint64
+	for _, v := range flags.Vals {
+		mask |= v
+	}
+	return mask
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
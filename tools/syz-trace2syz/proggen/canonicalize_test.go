@@ -0,0 +1,35 @@
+// Copyright 2018 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package proggen
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestAppendUint32(t *testing.T) {
+	tests := []uint32{0, 1, 0xdeadbeef, 0xffffffff}
+	for _, v := range tests {
+		buf := appendUint32([]byte("prefix"), v)
+		if len(buf) != len("prefix")+4 {
+			t.Fatalf("appendUint32(%#x): got length %d, want %d", v, len(buf), len("prefix")+4)
+		}
+		if got := binary.LittleEndian.Uint32(buf[len("prefix"):]); got != v {
+			t.Errorf("appendUint32(%#x): decoded %#x", v, got)
+		}
+	}
+}
+
+func TestAppendUint64(t *testing.T) {
+	tests := []uint64{0, 1, 0xdeadbeefcafebabe, 0xffffffffffffffff}
+	for _, v := range tests {
+		buf := appendUint64([]byte("prefix"), v)
+		if len(buf) != len("prefix")+8 {
+			t.Fatalf("appendUint64(%#x): got length %d, want %d", v, len(buf), len("prefix")+8)
+		}
+		if got := binary.LittleEndian.Uint64(buf[len("prefix"):]); got != v {
+			t.Errorf("appendUint64(%#x): decoded %#x", v, got)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright 2018 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package proggen
+
+import "github.com/google/syzkaller/prog"
+
+// CallSelector picks which concrete syscall variant to emit for a traced
+// syscall, e.g. mapping a raw ioctl(fd, cmd, ...) onto the right
+// resource-typed syzkaller call. It's scoped to a single target: the same
+// syscall name can resolve to entirely different resources on different
+// os/arch pairs, so two selectors for different targets must never share
+// state.
+type CallSelector struct {
+	target *prog.Target
+}
+
+// NewCallSelector returns a CallSelector scoped to target.
+func NewCallSelector(target *prog.Target) *CallSelector {
+	return &CallSelector{target: target}
+}
@@ -0,0 +1,46 @@
+// Copyright 2018 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+// seccompProfile is an OCI/libseccomp-compatible allow-list: everything not
+// named is denied by defaultAction.
+type seccompProfile struct {
+	DefaultAction string        `json:"defaultAction"`
+	Syscalls      []seccompRule `json:"syscalls"`
+}
+
+type seccompRule struct {
+	Names  []string `json:"names"`
+	Action string   `json:"action"`
+}
+
+// writeSeccompProfile writes dir/name.json listing exactly the syscalls in
+// syscalls, so a reproducer built from a real workload trace can be run under
+// the minimum seccomp filter that workload needs. syscalls should come from
+// the source trace, not from the (possibly FillOutMemory-augmented) final
+// program, or the profile will allow syscalls the workload never made.
+func writeSeccompProfile(dir, name string, syscalls []string) error {
+	names := append([]string(nil), syscalls...)
+	sort.Strings(names)
+
+	profile := seccompProfile{
+		DefaultAction: "SCMP_ACT_ERRNO",
+		Syscalls: []seccompRule{{
+			Names:  names,
+			Action: "SCMP_ACT_ALLOW",
+		}},
+	}
+	data, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name+".json"), data, 0640)
+}
@@ -0,0 +1,206 @@
+// Copyright 2018 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/syzkaller/pkg/log"
+	"github.com/google/syzkaller/prog"
+	"github.com/google/syzkaller/tools/syz-trace2syz/parser"
+	"github.com/google/syzkaller/tools/syz-trace2syz/proggen"
+)
+
+// resolveTargets builds the list of targets to try when converting a trace,
+// from -targets if given, otherwise from -os/-arch.
+func resolveTargets() []*prog.Target {
+	if *flagTargets == "" {
+		return []*prog.Target{initializeTarget(*flagOS, *flagArch)}
+	}
+	var targets []*prog.Target
+	for _, spec := range strings.Split(*flagTargets, ",") {
+		osArch := strings.SplitN(spec, "/", 2)
+		if len(osArch) != 2 {
+			log.Fatalf("invalid -targets entry %q, want os/arch", spec)
+		}
+		targets = append(targets, initializeTarget(osArch[0], osArch[1]))
+	}
+	return targets
+}
+
+// callSelectorEntry pairs a target's selector with the mutex that serializes
+// access to it, so workers converting traces for different targets never
+// block on each other - only workers that land on the same target do.
+type callSelectorEntry struct {
+	mu  sync.Mutex
+	sel *proggen.CallSelector
+}
+
+// callSelectors hands out one *proggen.CallSelector per target, so selector
+// state built up while converting one target's traces is never applied to an
+// incompatible target.
+type callSelectors struct {
+	mu    sync.Mutex
+	byKey map[string]*callSelectorEntry
+}
+
+func newCallSelectors() *callSelectors {
+	return &callSelectors{byKey: make(map[string]*callSelectorEntry)}
+}
+
+// get returns the entry for target, creating it on first use. The caller
+// must hold entry.mu for the duration of any call into entry.sel, since
+// *proggen.CallSelector isn't safe for concurrent use on its own.
+func (s *callSelectors) get(target *prog.Target) *callSelectorEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := target.OS + "/" + target.Arch
+	entry, ok := s.byKey[key]
+	if !ok {
+		entry = &callSelectorEntry{sel: proggen.NewCallSelector(target)}
+		s.byKey[key] = entry
+	}
+	return entry
+}
+
+// targetResult is one target's attempt at converting a single trace file.
+type targetResult struct {
+	target *prog.Target
+	ctxs   []*proggen.Context
+	calls  int
+	// traceSyscalls holds, per Context, the syscall names the source trace
+	// actually contained - see parseTree.
+	traceSyscalls map[*proggen.Context][]string
+}
+
+// targetAttempt is one target's outcome from convertForBestTarget's loop,
+// kept separate from the loop itself so the best-of-several selection can be
+// unit tested without the trace-parsing machinery that produces it.
+type targetAttempt struct {
+	target        *prog.Target
+	ctxs          []*proggen.Context
+	traceSyscalls map[*proggen.Context][]string
+	calls         int
+	err           error
+}
+
+// convertForBestTarget runs tree through every candidate target and returns
+// the one whose programs all validated with the most syscalls mapped. Targets
+// that fail to validate are recorded in stats and otherwise ignored.
+func convertForBestTarget(tree *parser.TraceTree, targets []*prog.Target, selectors *callSelectors,
+	stats *targetStats) (*targetResult, error) {
+	var attempts []targetAttempt
+	for _, target := range targets {
+		entry := selectors.get(target)
+		traceSyscalls := make(map[*proggen.Context][]string)
+
+		entry.mu.Lock()
+		ctxs := parseTree(tree, tree.RootPid, target, entry.sel, traceSyscalls)
+		entry.mu.Unlock()
+
+		calls, err := validateCtxs(ctxs)
+		stats.record(target, err == nil, calls)
+		attempts = append(attempts, targetAttempt{
+			target: target, ctxs: ctxs, traceSyscalls: traceSyscalls, calls: calls, err: err,
+		})
+	}
+	best, err := pickBestAttempt(attempts)
+	if err != nil {
+		return nil, err
+	}
+	stats.pick(best.target)
+	return best, nil
+}
+
+// pickBestAttempt returns whichever validated attempt (err == nil) mapped the
+// most calls, or the last error seen if none of attempts validated.
+func pickBestAttempt(attempts []targetAttempt) (*targetResult, error) {
+	var best *targetResult
+	var lastErr error
+	for _, a := range attempts {
+		if a.err != nil {
+			lastErr = a.err
+			continue
+		}
+		if best == nil || a.calls > best.calls {
+			best = &targetResult{target: a.target, ctxs: a.ctxs, calls: a.calls, traceSyscalls: a.traceSyscalls}
+		}
+	}
+	if best == nil {
+		return nil, lastErr
+	}
+	return best, nil
+}
+
+func validateCtxs(ctxs []*proggen.Context) (int, error) {
+	calls := 0
+	for _, ctx := range ctxs {
+		ctx.Prog.Target = ctx.Target
+		if err := ctx.FillOutMemory(); err != nil {
+			return calls, fmt.Errorf("failed to fill out memory: %s", err)
+		}
+		if err := ctx.Prog.Validate(); err != nil {
+			return calls, fmt.Errorf("error validating program: %s", err)
+		}
+		calls += len(ctx.Prog.Calls)
+	}
+	return calls, nil
+}
+
+// targetStats accumulates per-target conversion statistics across the whole
+// run, so multi-target batch conversion can report which targets a corpus of
+// traces actually belongs to.
+type targetStats struct {
+	mu    sync.Mutex
+	order []string
+	byKey map[string]*targetStat
+}
+
+type targetStat struct {
+	attempted, validated, picked, calls int
+}
+
+func newTargetStats() *targetStats {
+	return &targetStats{byKey: make(map[string]*targetStat)}
+}
+
+func (s *targetStats) record(target *prog.Target, validated bool, calls int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := target.OS + "/" + target.Arch
+	st, ok := s.byKey[key]
+	if !ok {
+		st = &targetStat{}
+		s.byKey[key] = st
+		s.order = append(s.order, key)
+	}
+	st.attempted++
+	if validated {
+		st.validated++
+		st.calls += calls
+	}
+}
+
+func (s *targetStats) pick(target *prog.Target) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byKey[target.OS+"/"+target.Arch].picked++
+}
+
+// log prints per-target statistics, but only when more than one target was
+// actually in play - a single-target run has nothing interesting to compare.
+func (s *targetStats) log() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.order) <= 1 {
+		return
+	}
+	for _, key := range s.order {
+		st := s.byKey[key]
+		log.Logf(0, "target %s: %d/%d traces validated, %d picked as best, %d calls mapped",
+			key, st.validated, st.attempted, st.picked, st.calls)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/syzkaller/prog"
+)
+
+func TestPickBestAttemptMostCalls(t *testing.T) {
+	amd64 := &prog.Target{OS: "linux", Arch: "amd64"}
+	arm64 := &prog.Target{OS: "linux", Arch: "arm64"}
+
+	best, err := pickBestAttempt([]targetAttempt{
+		{target: amd64, calls: 3},
+		{target: arm64, calls: 5},
+	})
+	if err != nil {
+		t.Fatalf("pickBestAttempt failed: %v", err)
+	}
+	if best.target != arm64 || best.calls != 5 {
+		t.Errorf("picked target=%v calls=%d, want arm64 with 5 calls", best.target, best.calls)
+	}
+}
+
+func TestPickBestAttemptSkipsFailedTargets(t *testing.T) {
+	amd64 := &prog.Target{OS: "linux", Arch: "amd64"}
+	arm64 := &prog.Target{OS: "linux", Arch: "arm64"}
+
+	best, err := pickBestAttempt([]targetAttempt{
+		{target: amd64, err: errors.New("validate failed")},
+		{target: arm64, calls: 2},
+	})
+	if err != nil {
+		t.Fatalf("pickBestAttempt failed: %v", err)
+	}
+	if best.target != arm64 {
+		t.Errorf("picked %v, want arm64 (the only validated target)", best.target)
+	}
+}
+
+func TestPickBestAttemptAllFailed(t *testing.T) {
+	amd64 := &prog.Target{OS: "linux", Arch: "amd64"}
+	wantErr := errors.New("validate failed")
+
+	best, err := pickBestAttempt([]targetAttempt{{target: amd64, err: wantErr}})
+	if best != nil {
+		t.Errorf("best = %v, want nil", best)
+	}
+	if err != wantErr {
+		t.Errorf("err = %v, want %v", err, wantErr)
+	}
+}
+
+func TestTargetStatsRecordAndPick(t *testing.T) {
+	amd64 := &prog.Target{OS: "linux", Arch: "amd64"}
+	arm64 := &prog.Target{OS: "linux", Arch: "arm64"}
+
+	stats := newTargetStats()
+	stats.record(amd64, true, 3)
+	stats.record(amd64, false, 0)
+	stats.record(arm64, true, 5)
+	stats.pick(arm64)
+
+	st := stats.byKey["linux/amd64"]
+	if st.attempted != 2 || st.validated != 1 || st.calls != 3 || st.picked != 0 {
+		t.Errorf("linux/amd64 stats = %+v", st)
+	}
+	st = stats.byKey["linux/arm64"]
+	if st.attempted != 1 || st.validated != 1 || st.calls != 5 || st.picked != 1 {
+		t.Errorf("linux/arm64 stats = %+v", st)
+	}
+}
@@ -7,6 +7,14 @@
 //	strace -o trace -a 1 -s 65500 -v -xx -f -Xraw ./a.out
 //	syz-trace2syz -file trace
 // Intended for seed selection or debugging
+//
+// -file and -dir also accept .gz/.zst compressed traces and tar/tar.gz
+// bundles of traces; see -format to force detection when the extension
+// doesn't make that obvious. -seccomp additionally emits, per converted
+// program, the minimal seccomp allow-list profile for the syscalls its source
+// trace made.
+// The target defaults to linux/amd64; -os/-arch pick a different one, and
+// -targets tries several per trace and keeps whichever validates the most calls.
 package main
 
 import (
@@ -15,7 +23,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/syzkaller/pkg/db"
 	"github.com/google/syzkaller/pkg/hash"
@@ -30,21 +43,32 @@ var (
 	flagFile        = flag.String("file", "", "file to parse")
 	flagDir         = flag.String("dir", "", "directory to parse")
 	flagDeserialize = flag.String("deserialize", "", "(Optional) directory to store deserialized programs")
-	callSelector    = proggen.NewCallSelector()
+	flagJobs        = flag.Int("jobs", runtime.NumCPU(), "number of trace files to convert in parallel")
+	flagFormat      = flag.String("format", "auto", "input trace format: auto, strace, tar")
+	flagSeccomp     = flag.String("seccomp", "", "(Optional) directory to write a seccomp allow-list profile per converted program")
+	flagOS          = flag.String("os", goos, "target OS")
+	flagArch        = flag.String("arch", arch, "target architecture")
+	flagTargets     = flag.String("targets", "", "(Optional) comma-separated os/arch pairs to try per trace, e.g. linux/amd64,linux/arm64; overrides -os/-arch")
 )
 
 const (
 	goos             = "linux" // Target OS
 	arch             = "amd64" // Target architecture
 	currentDBVersion = 3       // Marked as minimized
+
+	corpusDBName     = "corpus.db"
+	checkpointSuffix = ".checkpoint"
+
+	// flushBatchSize caps how many converted files can be ahead of the last
+	// corpus.db flush; their checkpoint marks are written only once that flush
+	// succeeds (see flushBatch).
+	flushBatchSize = 200
 )
 
 func main() {
 	flag.Parse()
-	target := initializeTarget(goos, arch)
-	progs := parseTraces(target)
-	log.Logf(0, "successfully converted traces; generating corpus.db")
-	pack(progs)
+	targets := resolveTargets()
+	convertTraces(targets)
 }
 
 func initializeTarget(os, arch string) *prog.Target {
@@ -59,10 +83,19 @@ func initializeTarget(os, arch string) *prog.Target {
 	return target
 }
 
-func parseTraces(target *prog.Target) []*prog.Prog {
-	var ret []*prog.Prog
-	var names []string
+// fileResult is what a worker hands back to the writer for a single trace file.
+type fileResult struct {
+	file  string
+	progs []*prog.Prog
+	err   error
+}
 
+// convertTraces fans the per-file conversion work out across -jobs workers and
+// streams the results to a single writer that owns corpus.db, so traces that
+// were already converted in a previous run (per the on-disk checkpoint) are
+// skipped instead of reparsed.
+func convertTraces(targets []*prog.Target) {
+	var names []string
 	if *flagFile != "" {
 		names = append(names, *flagFile)
 	} else if *flagDir != "" {
@@ -71,44 +104,156 @@ func parseTraces(target *prog.Target) []*prog.Prog {
 		log.Fatalf("-file or -dir must be specified")
 	}
 
-	deserializeDir := *flagDeserialize
+	tmpDir, err := ioutil.TempDir("", "syz-trace2syz")
+	if err != nil {
+		log.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	format := parseFormatFlag(*flagFormat)
 
-	totalFiles := len(names)
-	log.Logf(0, "parsing %d traces", totalFiles)
-	for i, file := range names {
-		log.Logf(1, "parsing File %d/%d: %s", i+1, totalFiles, filepath.Base(names[i]))
-		tree := parser.Parse(file)
-		if tree == nil {
-			log.Logf(1, "file: %s is empty", filepath.Base(file))
+	cp := openCheckpoint(corpusDBName)
+	defer cp.close()
+
+	var pending []string
+	for _, name := range names {
+		if cp.skip(name) {
 			continue
 		}
-		ctxs := parseTree(tree, tree.RootPid, target)
-		for i, ctx := range ctxs {
-			ctx.Prog.Target = ctx.Target
-			err := ctx.FillOutMemory()
-			if err != nil {
-				log.Logf(1, "failed to fill out memory %s", err)
-				continue
+		pending = append(pending, name)
+	}
+	if skipped := len(names) - len(pending); skipped > 0 {
+		log.Logf(0, "skipping %d already converted traces (checkpoint)", skipped)
+	}
+	log.Logf(0, "parsing %d traces with %d workers", len(pending), *flagJobs)
+
+	syzDb, err := db.Open(corpusDBName)
+	if err != nil {
+		log.Fatalf("failed to open database file: %v", err)
+	}
+	syzDb.BumpVersion(currentDBVersion)
+	dedup := newDedupIndex(syzDb, targets)
+	selectors := newCallSelectors()
+	stats := newTargetStats()
+
+	jobs := make(chan string, len(pending))
+	for _, name := range pending {
+		jobs <- name
+	}
+	close(jobs)
+
+	numWorkers := *flagJobs
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	results := make(chan fileResult, numWorkers)
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			worker(targets, selectors, stats, jobs, results, tmpDir, format)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	start := time.Now()
+	var converted, failed, totalProgs uint64
+	var unflushed []string
+
+	// This loop is the single writer: it's the only place that touches syzDb and
+	// the checkpoint file, so neither needs its own locking.
+	for res := range results {
+		if res.err != nil {
+			atomic.AddUint64(&failed, 1)
+			log.Logf(0, "failed to convert %s: %v", filepath.Base(res.file), res.err)
+			continue
+		}
+		for _, p := range res.progs {
+			dedup.save(hash.String(p.Serialize()), p)
+		}
+		unflushed = append(unflushed, res.file)
+		converted++
+		totalProgs += uint64(len(res.progs))
+		if len(unflushed) >= flushBatchSize {
+			if err := flushBatch(cp, syzDb.Flush, unflushed); err != nil {
+				log.Fatalf("failed to save database file: %v", err)
 			}
-			if err := ctx.Prog.Validate(); err != nil {
-				log.Fatalf("error validating program: %s", err)
+			unflushed = unflushed[:0]
+		}
+	}
+	if err := flushBatch(cp, syzDb.Flush, unflushed); err != nil {
+		log.Fatalf("failed to save database file: %v", err)
+	}
+
+	dedup.logStats()
+	stats.log()
+
+	elapsed := time.Since(start)
+	log.Logf(0, "converted %d/%d traces (%d failed) into %d programs in %s (%.1f traces/sec)",
+		converted, len(pending), failed, totalProgs, elapsed.Round(time.Millisecond), float64(converted)/elapsed.Seconds())
+}
+
+func worker(targets []*prog.Target, selectors *callSelectors, stats *targetStats,
+	jobs <-chan string, results chan<- fileResult, tmpDir string, format traceFormat) {
+	for file := range jobs {
+		progs, err := convertFile(targets, selectors, stats, file, tmpDir, format, *flagDeserialize)
+		results <- fileResult{file: file, progs: progs, err: err}
+	}
+}
+
+// convertFile runs a single -file/-dir entry through expandTraceFile (which
+// transparently streams compressed or archived input) and then, for every
+// trace entry it yields, through Parse -> parseTree -> FillOutMemory ->
+// Validate -> Serialize, using whichever of targets converts it best. It's
+// safe to call concurrently from multiple workers.
+func convertFile(targets []*prog.Target, selectors *callSelectors, stats *targetStats,
+	origFile, tmpDir string, format traceFormat, deserializeDir string) ([]*prog.Prog, error) {
+	var progs []*prog.Prog
+	err := expandTraceFile(origFile, format, tmpDir, func(member traceMember) error {
+		tree := parser.Parse(member.path)
+		if tree == nil {
+			log.Logf(1, "file: %s is empty", member.name)
+			return nil
+		}
+
+		best, err := convertForBestTarget(tree, targets, selectors, stats)
+		if err != nil {
+			if len(targets) == 1 {
+				return fmt.Errorf("error validating program: %s", err)
 			}
+			log.Logf(1, "no target could validate %s: %v", member.name, err)
+			return nil
+		}
+
+		for i, ctx := range best.ctxs {
 			if progIsTooLarge(ctx.Prog) {
 				log.Logf(1, "prog is too large")
 				continue
 			}
-			ret = append(ret, ctx.Prog)
+			progs = append(progs, ctx.Prog)
+			if *flagSeccomp != "" {
+				name := fmt.Sprintf("%s_%d", member.name, i)
+				if err := writeSeccompProfile(*flagSeccomp, name, best.traceSyscalls[ctx]); err != nil {
+					return fmt.Errorf("failed to write seccomp profile: %v", err)
+				}
+			}
 			if deserializeDir == "" {
 				continue
 			}
-			progName := filepath.Join(deserializeDir, filepath.Base(file)+strconv.Itoa(i))
+			progName := filepath.Join(deserializeDir, member.name+strconv.Itoa(i))
 			if err := ioutil.WriteFile(progName, ctx.Prog.Serialize(), 0640); err != nil {
-				log.Fatalf("failed to output file: %v", err)
+				return fmt.Errorf("failed to output file: %v", err)
 			}
 		}
-
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to unpack %s: %v", origFile, err)
 	}
-	return ret
+	return progs, nil
 }
 
 func progIsTooLarge(p *prog.Prog) bool {
@@ -135,39 +280,99 @@ func getTraceFiles(dir string) []string {
 
 // parseTree groups system calls in the trace by process id.
 // The tree preserves process hierarchy i.e. parent->[]child
-func parseTree(tree *parser.TraceTree, pid int64, target *prog.Target) []*proggen.Context {
+//
+// traceSyscalls records, for every Context this produces, the set of syscall
+// names the trace actually contained - captured right after GenSyzProg builds
+// the call list, before FillOutMemory gets a chance to inject calls (e.g. an
+// mmap to back a pointer argument) that never appeared in the source trace.
+func parseTree(tree *parser.TraceTree, pid int64, target *prog.Target, sel *proggen.CallSelector,
+	traceSyscalls map[*proggen.Context][]string) []*proggen.Context {
 	log.Logf(2, "parsing trace: %s", tree.Filename)
 	var ctxs []*proggen.Context
-	ctx := proggen.GenSyzProg(tree.TraceMap[pid], target, callSelector)
+	ctx := proggen.GenSyzProg(tree.TraceMap[pid], target, sel)
+	traceSyscalls[ctx] = syscallNames(ctx.Prog.Calls)
 
 	ctxs = append(ctxs, ctx)
 	for _, childPid := range tree.Ptree[pid] {
 		if tree.TraceMap[childPid] != nil {
-			ctxs = append(ctxs, parseTree(tree, childPid, target)...)
+			ctxs = append(ctxs, parseTree(tree, childPid, target, sel, traceSyscalls)...)
 		}
 	}
 	return ctxs
 }
 
-func pack(progs []*prog.Prog) {
-	corpusDb := "corpus.db"
-	os.Remove(corpusDb)
-	syzDb, err := db.Open(corpusDb)
+func syscallNames(calls []*prog.Call) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, call := range calls {
+		if seen[call.Meta.CallName] {
+			continue
+		}
+		seen[call.Meta.CallName] = true
+		names = append(names, call.Meta.CallName)
+	}
+	return names
+}
+
+// checkpoint records which trace files have already been converted into corpus.db,
+// so a re-run against -dir can skip them instead of reparsing.
+type checkpoint struct {
+	mu   sync.Mutex
+	done map[string]bool
+	file *os.File
+}
 
+func openCheckpoint(dbPath string) *checkpoint {
+	path := dbPath + checkpointSuffix
+	cp := &checkpoint{done: make(map[string]bool)}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if line != "" {
+				cp.done[line] = true
+			}
+		}
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
 	if err != nil {
-		log.Fatalf("failed to open database file: %v", err)
+		log.Fatalf("failed to open checkpoint file: %v", err)
 	}
-	syzDb.BumpVersion(currentDBVersion)
-	for i, prog := range progs {
-		data := prog.Serialize()
-		key := hash.String(data)
-		if _, ok := syzDb.Records[key]; ok {
-			key += fmt.Sprint(i)
-		}
-		syzDb.Save(key, data, 0)
+	cp.file = f
+	return cp
+}
+
+func (cp *checkpoint) skip(name string) bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.done[name]
+}
+
+func (cp *checkpoint) mark(name string) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.done[name] {
+		return
 	}
-	if err := syzDb.Flush(); err != nil {
-		log.Fatalf("failed to save database file: %v", err)
+	cp.done[name] = true
+	fmt.Fprintln(cp.file, name)
+}
+
+func (cp *checkpoint) close() {
+	cp.file.Close()
+}
+
+// flushBatch persists files's converted programs via flush before marking
+// each of them done in cp, so a checkpoint entry is never written ahead of
+// the corpus.db flush that makes it actually durable. It's a no-op, and
+// flush is never called, if files is empty.
+func flushBatch(cp *checkpoint, flush func() error, files []string) error {
+	if len(files) == 0 {
+		return nil
+	}
+	if err := flush(); err != nil {
+		return err
 	}
-	log.Logf(0, "finished!")
-}
\ No newline at end of file
+	for _, name := range files {
+		cp.mark(name)
+	}
+	return nil
+}
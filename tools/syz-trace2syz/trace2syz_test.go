@@ -0,0 +1,45 @@
+// Copyright 2018 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestFlushBatchNoFiles(t *testing.T) {
+	called := false
+	cp := &checkpoint{done: make(map[string]bool)}
+	if err := flushBatch(cp, func() error { called = true; return nil }, nil); err != nil {
+		t.Fatalf("flushBatch failed: %v", err)
+	}
+	if called {
+		t.Errorf("flushBatch flushed with nothing pending")
+	}
+}
+
+func TestFlushBatchMarksOnlyAfterSuccessfulFlush(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cp := &checkpoint{done: make(map[string]bool), file: f}
+
+	flushErr := errors.New("flush failed")
+	if err := flushBatch(cp, func() error { return flushErr }, []string{"a", "b"}); err != flushErr {
+		t.Fatalf("flushBatch error = %v, want %v", err, flushErr)
+	}
+	if cp.skip("a") || cp.skip("b") {
+		t.Fatalf("checkpoint marked files done despite a failed flush")
+	}
+
+	if err := flushBatch(cp, func() error { return nil }, []string{"a", "b"}); err != nil {
+		t.Fatalf("flushBatch failed: %v", err)
+	}
+	if !cp.skip("a") || !cp.skip("b") {
+		t.Errorf("checkpoint should mark files done once their flush succeeds")
+	}
+}